@@ -0,0 +1,241 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/ssh"
+)
+
+// ACMEChallengeType selects which ACME challenge type is used to prove
+// control of the identity named in the issued certificate.
+type ACMEChallengeType string
+
+const (
+	// ACMEChallengeHTTP01 proves control via a well-known HTTP path.
+	ACMEChallengeHTTP01 ACMEChallengeType = "http-01"
+	// ACMEChallengeDNS01 proves control via a TXT record.
+	ACMEChallengeDNS01 ACMEChallengeType = "dns-01"
+)
+
+// ACMEConfig configures an ACME-issued client identity.
+type ACMEConfig struct {
+	// DirectoryURL is the ACME directory endpoint to order certificates
+	// from (e.g. a private CA run for bot/service identities).
+	DirectoryURL string
+	// Identity is the SAN (typically a DNS name bound to a Teleport
+	// bot/user identity) the issued certificate should cover.
+	Identity string
+	// ChallengeType selects how control of Identity is proven.
+	ChallengeType ACMEChallengeType
+	// CacheDir is where the issued key/cert pair is cached across
+	// process restarts. Required.
+	CacheDir string
+	// Solver completes the chosen challenge (e.g. serving the HTTP-01
+	// token or publishing the DNS-01 TXT record) for Identity.
+	Solver ACMEChallengeSolver
+	// DisableNoncePrefetch disables the client's GET/HEAD nonce
+	// prefetch optimization described in RFC 8555 7.2, useful against
+	// directories that don't support it.
+	DisableNoncePrefetch bool
+}
+
+// ACMEChallengeSolver completes an ACME challenge for identity and
+// blocks until the CA should be able to validate it.
+type ACMEChallengeSolver interface {
+	Solve(ctx context.Context, identity string, chal *acme.Challenge) error
+}
+
+func (c *ACMEConfig) checkAndSetDefaults() error {
+	if c.DirectoryURL == "" {
+		return trace.BadParameter("ACME directory URL must be supplied")
+	}
+	if c.Identity == "" {
+		return trace.BadParameter("identity must be supplied")
+	}
+	if c.CacheDir == "" {
+		return trace.BadParameter("cache dir must be supplied")
+	}
+	if c.Solver == nil {
+		return trace.BadParameter("challenge solver must be supplied")
+	}
+	if c.ChallengeType == "" {
+		c.ChallengeType = ACMEChallengeHTTP01
+	}
+	return nil
+}
+
+// ACMECreds is a Credentials implementation backed by a client
+// certificate issued through an ACME order, identifying a Teleport
+// bot/user by SAN rather than a hand-provisioned identity file. Auth
+// server admins map that SAN to roles the same way they would for any
+// other x509 identity.
+type ACMECreds struct {
+	cfg ACMEConfig
+}
+
+// LoadACME obtains (issuing and caching on disk if necessary) a client
+// identity via ACME and returns Credentials backed by it.
+func LoadACME(ctx context.Context, config ACMEConfig) (*ACMECreds, error) {
+	if err := config.checkAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	c := &ACMECreds{cfg: config}
+	if _, err := os.Stat(c.certPath()); err == nil {
+		// A cached identity already exists; renewal is handled by
+		// wrapping this Credentials in a RefreshingCreds (see
+		// NewRefreshingCreds), not by re-ordering here.
+		return c, nil
+	}
+
+	if err := c.issue(ctx); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return c, nil
+}
+
+func (c *ACMECreds) keyPath() string  { return filepath.Join(c.cfg.CacheDir, "acme_key.pem") }
+func (c *ACMECreds) certPath() string { return filepath.Join(c.cfg.CacheDir, "acme_cert.pem") }
+
+// issue performs an ACME order for c.cfg.Identity and caches the
+// resulting key/cert pair on disk.
+func (c *ACMECreds) issue(ctx context.Context) error {
+	if err := os.MkdirAll(c.cfg.CacheDir, 0700); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: c.cfg.DirectoryURL,
+	}
+	if c.cfg.DisableNoncePrefetch {
+		client.DirOptions = []acme.DirOpt{acme.DirOptNoPrefetchNonce}
+	}
+
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return trace.Wrap(err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, []acme.AuthzID{{Type: "dns", Value: c.cfg.Identity}})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, candidate := range authz.Challenges {
+			if candidate.Type == string(c.cfg.ChallengeType) {
+				chal = candidate
+				break
+			}
+		}
+		if chal == nil {
+			return trace.BadParameter("no %v challenge offered for %v", c.cfg.ChallengeType, c.cfg.Identity)
+		}
+
+		if err := c.cfg.Solver.Solve(ctx, c.cfg.Identity, chal); err != nil {
+			return trace.Wrap(err)
+		}
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return trace.Wrap(err)
+		}
+		if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: c.cfg.Identity},
+		DNSNames: []string{c.cfg.Identity},
+	}, leafKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	leafKeyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: leafKeyDER})
+	if err := ioutil.WriteFile(c.keyPath(), keyPEM, 0600); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	var certPEM []byte
+	for _, block := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block})...)
+	}
+	if err := ioutil.WriteFile(c.certPath(), certPEM, 0600); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	return nil
+}
+
+func (c *ACMECreds) Dialer() (ContextDialer, error) {
+	return nil, trace.NotImplemented("no dialer")
+}
+
+func (c *ACMECreds) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.certPath(), c.keyPath())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return configure(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}), nil
+}
+
+func (c *ACMECreds) SSHConfig() (*ssh.ClientConfig, error) {
+	return nil, nil
+}
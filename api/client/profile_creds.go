@@ -0,0 +1,235 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultProfileDir is where LoadProfile looks for tsh profiles when
+// profileDir is not supplied, mirroring the ~/.consul-style convention
+// used by HashiCorp clients for their own CLI-managed credentials.
+const defaultProfileDir = ".tsh"
+
+// profileYAML is the subset of tsh's profile.yaml this package cares
+// about.
+type profileYAML struct {
+	ProxyAddr string `yaml:"proxy_addr"`
+	Username  string `yaml:"username"`
+	Current   bool   `yaml:"current,omitempty"`
+}
+
+// ErrProfileNotFound is returned by LoadProfile when no tsh profile
+// matches the requested proxy address, so callers can prompt the user
+// to run `tsh login` instead of failing with an opaque file error.
+var ErrProfileNotFound = trace.NotFound("no tsh profile found; run 'tsh login' first")
+
+// ProfileCreds implements Credentials by reading an existing tsh
+// profile directory, bridging credentials issued by `tsh login` into
+// the Go client without each caller having to hand-roll the same
+// profile.yaml + key/cert parsing.
+type ProfileCreds struct {
+	dir            string
+	proxyAddr      string
+	username       string
+	keyFile        string
+	certFile       string
+	caFile         string
+	sshCert        string
+	knownHostsFile string
+}
+
+// LoadProfile loads the tsh profile matching proxyAddr (or the profile
+// marked "current" if proxyAddr is empty) out of profileDir, defaulting
+// profileDir to ~/.tsh. It returns ErrProfileNotFound if no matching
+// profile exists.
+func LoadProfile(profileDir, proxyAddr string) (*ProfileCreds, error) {
+	if profileDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		profileDir = filepath.Join(home, defaultProfileDir)
+	}
+
+	proxyDir, profile, err := findProfile(profileDir, proxyAddr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &ProfileCreds{
+		dir:            profileDir,
+		proxyAddr:      profile.ProxyAddr,
+		username:       profile.Username,
+		keyFile:        filepath.Join(profileDir, "keys", proxyDir, profile.Username),
+		certFile:       filepath.Join(profileDir, "keys", proxyDir, profile.Username+"-x509.pem"),
+		caFile:         filepath.Join(profileDir, "keys", proxyDir, "certs.pem"),
+		sshCert:        filepath.Join(profileDir, "keys", proxyDir, profile.Username+"-ssh", proxyDir+"-cert.pub"),
+		knownHostsFile: filepath.Join(profileDir, "known_hosts"),
+	}, nil
+}
+
+// findProfile locates the proxy subdirectory (and parses its
+// profile.yaml) matching proxyAddr, or the one marked current if
+// proxyAddr is empty.
+func findProfile(profileDir, proxyAddr string) (string, *profileYAML, error) {
+	if proxyAddr != "" {
+		data, err := ioutil.ReadFile(filepath.Join(profileDir, proxyAddr+".yaml"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", nil, trace.Wrap(ErrProfileNotFound)
+			}
+			return "", nil, trace.ConvertSystemError(err)
+		}
+		var profile profileYAML
+		if err := yaml.Unmarshal(data, &profile); err != nil {
+			return "", nil, trace.Wrap(err)
+		}
+		return proxyAddr, &profile, nil
+	}
+
+	entries, err := ioutil.ReadDir(profileDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil, trace.Wrap(ErrProfileNotFound)
+		}
+		return "", nil, trace.ConvertSystemError(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(profileDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var profile profileYAML
+		if err := yaml.Unmarshal(data, &profile); err != nil {
+			continue
+		}
+		if profile.Current {
+			return strings.TrimSuffix(entry.Name(), ".yaml"), &profile, nil
+		}
+	}
+	return "", nil, trace.Wrap(ErrProfileNotFound)
+}
+
+// profileDialer dials the proxy address recorded in a tsh profile,
+// ignoring whatever address the caller asks for; the profile is the
+// authority on where this cluster's proxy actually lives.
+type profileDialer struct {
+	proxyAddr string
+}
+
+func (d *profileDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, d.proxyAddr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return conn, nil
+}
+
+func (c *ProfileCreds) Dialer() (ContextDialer, error) {
+	if c.proxyAddr == "" {
+		return nil, trace.BadParameter("tsh profile has no proxy address")
+	}
+	return &profileDialer{proxyAddr: c.proxyAddr}, nil
+}
+
+func (c *ProfileCreds) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	cas, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(cas); !ok {
+		return nil, trace.BadParameter("invalid TLS CA cert PEM")
+	}
+
+	return configure(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}), nil
+}
+
+// SSHConfig builds an ssh.ClientConfig directly from the tsh profile's
+// raw OpenSSH key and certificate files. It intentionally does not go
+// through ReadIdentityFile/IdentityCreds: that path parses the bundled
+// identity-file format (key+cert+CA concatenated into one file), which
+// is a different on-disk format from tsh's profile directory, where the
+// SSH private key and the authorized-key-formatted certificate live in
+// separate files alongside the TLS material.
+func (c *ProfileCreds) SSHConfig() (*ssh.ClientConfig, error) {
+	keyBytes, err := ioutil.ReadFile(c.keyFile)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, trace.BadParameter("tsh profile SSH key could not be parsed: %v", err)
+	}
+
+	certBytes, err := ioutil.ReadFile(c.sshCert)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, trace.BadParameter("tsh profile SSH cert could not be parsed: %v", err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, trace.BadParameter("%v does not contain an SSH certificate", c.sshCert)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// `tsh login` writes each cluster's SSH host CA into this profile's
+	// known_hosts as an `@cert-authority` line; knownhosts.New parses
+	// that format directly and returns a callback that verifies host
+	// certificates against it, the same trust tsh's own SSH client uses.
+	hostKeyCallback, err := knownhosts.New(c.knownHostsFile)
+	if err != nil {
+		return nil, trace.Wrap(err, "could not load tsh known_hosts for host certificate verification; run 'tsh login' to regenerate it")
+	}
+
+	return &ssh.ClientConfig{
+		User:            c.username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
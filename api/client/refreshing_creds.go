@@ -0,0 +1,309 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultRefreshThreshold is the fraction of a certificate's remaining
+// lifetime at which RefreshingCreds attempts to swap it out.
+const defaultRefreshThreshold = 0.25
+
+// defaultCheckInterval is how often RefreshingCreds checks the current
+// leaf certificate's expiry if the caller did not supply one.
+const defaultCheckInterval = time.Minute
+
+// RefreshFunc loads a new set of Credentials, e.g. by re-reading an
+// identity file that an external process has renewed, or by requesting
+// a new one from the Auth server.
+type RefreshFunc func(ctx context.Context) (Credentials, error)
+
+// RefreshingCredsConfig configures a RefreshingCreds wrapper.
+type RefreshingCredsConfig struct {
+	// Inner is the Credentials to wrap. Its TLSConfig() is called once
+	// up front to seed the initial certificate.
+	Inner Credentials
+	// Refresh is called to load replacement Credentials once the
+	// current leaf certificate has crossed the refresh threshold.
+	Refresh RefreshFunc
+	// CheckInterval is how often a background goroutine checks the leaf
+	// certificate's NotAfter and, if the refresh threshold has been
+	// crossed, calls Refresh. It also bounds how long any single Refresh
+	// call (background or triggered by TLSConfig()/SSHConfig()) is
+	// allowed to run. Defaults to defaultCheckInterval.
+	CheckInterval time.Duration
+	// RefreshThreshold is the fraction (0, 1) of the certificate's
+	// total lifetime remaining at which a refresh is triggered.
+	// Defaults to defaultRefreshThreshold (25%).
+	RefreshThreshold float64
+	// OnExpiry, if set, is called whenever a refresh attempt fails and
+	// the current certificate is already past its NotAfter, so callers
+	// can surface a hard failure (e.g. terminate a long-running agent)
+	// instead of silently continuing to dial with an expired cert.
+	OnExpiry func(error)
+}
+
+func (c *RefreshingCredsConfig) checkAndSetDefaults() error {
+	if c.Inner == nil {
+		return trace.BadParameter("inner credentials must be supplied")
+	}
+	if c.Refresh == nil {
+		return trace.BadParameter("refresh func must be supplied")
+	}
+	if c.CheckInterval == 0 {
+		c.CheckInterval = defaultCheckInterval
+	}
+	if c.RefreshThreshold == 0 {
+		c.RefreshThreshold = defaultRefreshThreshold
+	}
+	return nil
+}
+
+// NewRefreshingCreds wraps inner Credentials with periodic renewal,
+// mirroring the periodic-renewal pattern used by ACME/step-style
+// short-lived cert clients. It is safe for concurrent use; in-flight
+// TLS handshakes will see either the old or the new certificate, never
+// a torn state.
+func NewRefreshingCreds(config RefreshingCredsConfig) (*RefreshingCreds, error) {
+	if err := config.checkAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	tlsConfig, err := config.Inner.TLSConfig()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sshConfig, err := config.Inner.SSHConfig()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	r := &RefreshingCreds{
+		cfg:  config,
+		done: make(chan struct{}),
+	}
+	r.state.Store(&refreshingCredsState{
+		creds:     config.Inner,
+		tlsConfig: tlsConfig,
+		sshConfig: sshConfig,
+	})
+
+	notBefore, notAfter, err := leafValidity(tlsConfig)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	st := r.state.Load().(*refreshingCredsState)
+	st.notBefore, st.notAfter = notBefore, notAfter
+
+	go r.refreshLoop()
+
+	return r, nil
+}
+
+// refreshingCredsState is the atomically-swapped snapshot of the
+// currently active credentials.
+type refreshingCredsState struct {
+	creds     Credentials
+	tlsConfig *tls.Config
+	sshConfig *ssh.ClientConfig
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// RefreshingCreds wraps another Credentials implementation and
+// transparently swaps the underlying tls.Config/ssh.ClientConfig once
+// the current leaf certificate has crossed a configurable threshold of
+// its remaining lifetime, so long-running clients don't need to be
+// restarted when a short-TTL identity file expires.
+type RefreshingCreds struct {
+	cfg   RefreshingCredsConfig
+	state atomic.Value // *refreshingCredsState
+
+	mu sync.Mutex // serializes concurrent refresh attempts
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *RefreshingCreds) Dialer() (ContextDialer, error) {
+	return r.current().creds.Dialer()
+}
+
+// Close stops the background refresh loop started by NewRefreshingCreds.
+// It does not affect any Credentials already handed out by TLSConfig()/
+// SSHConfig(); those remain usable, just no longer auto-refreshed.
+func (r *RefreshingCreds) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	return nil
+}
+
+// refreshLoop calls maybeRefresh every CheckInterval until Close is
+// called, so a long-running client that never calls TLSConfig()/
+// SSHConfig() again after its initial dial still gets its certificate
+// refreshed before it expires.
+func (r *RefreshingCreds) refreshLoop() {
+	ticker := time.NewTicker(r.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.maybeRefresh()
+		}
+	}
+}
+
+// TLSConfig returns the TLS configuration for the currently active
+// credentials, refreshing first if the threshold has been crossed.
+func (r *RefreshingCreds) TLSConfig() (*tls.Config, error) {
+	r.maybeRefresh()
+	return r.current().tlsConfig, nil
+}
+
+// SSHConfig returns the SSH configuration for the currently active
+// credentials, refreshing first if the threshold has been crossed.
+func (r *RefreshingCreds) SSHConfig() (*ssh.ClientConfig, error) {
+	r.maybeRefresh()
+	return r.current().sshConfig, nil
+}
+
+func (r *RefreshingCreds) current() *refreshingCredsState {
+	return r.state.Load().(*refreshingCredsState)
+}
+
+// maybeRefresh refreshes the underlying credentials if the current
+// leaf certificate's remaining lifetime has crossed RefreshThreshold.
+// Safe for concurrent callers: only one refresh runs at a time, and
+// readers always see a complete (old or new) state.
+func (r *RefreshingCreds) maybeRefresh() {
+	st := r.current()
+	if !shouldRefresh(st.notBefore, st.notAfter, time.Now(), r.cfg.RefreshThreshold) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Another goroutine may have already refreshed while we waited on
+	// the lock; re-check before doing the work again.
+	st = r.current()
+	if !shouldRefresh(st.notBefore, st.notAfter, time.Now(), r.cfg.RefreshThreshold) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.CheckInterval)
+	defer cancel()
+
+	creds, err := r.cfg.Refresh(ctx)
+	if err != nil {
+		if time.Now().After(st.notAfter) && r.cfg.OnExpiry != nil {
+			r.cfg.OnExpiry(trace.Wrap(err, "certificate expired and refresh failed"))
+		}
+		return
+	}
+
+	tlsConfig, err := creds.TLSConfig()
+	if err != nil {
+		if time.Now().After(st.notAfter) && r.cfg.OnExpiry != nil {
+			r.cfg.OnExpiry(trace.Wrap(err))
+		}
+		return
+	}
+	sshConfig, err := creds.SSHConfig()
+	if err != nil {
+		if time.Now().After(st.notAfter) && r.cfg.OnExpiry != nil {
+			r.cfg.OnExpiry(trace.Wrap(err))
+		}
+		return
+	}
+	notBefore, notAfter, err := leafValidity(tlsConfig)
+	if err != nil {
+		if time.Now().After(st.notAfter) && r.cfg.OnExpiry != nil {
+			r.cfg.OnExpiry(trace.Wrap(err))
+		}
+		return
+	}
+
+	// Atomically re-point to the new state; in-flight GetClientCertificate
+	// calls already holding the old *tls.Config keep using the old cert.
+	r.state.Store(&refreshingCredsState{
+		creds:     creds,
+		tlsConfig: tlsConfig,
+		sshConfig: sshConfig,
+		notBefore: notBefore,
+		notAfter:  notAfter,
+	})
+}
+
+// shouldRefresh reports whether now has crossed the refresh threshold
+// of the certificate's total (notBefore, notAfter) lifetime.
+func shouldRefresh(notBefore, notAfter, now time.Time, threshold float64) bool {
+	if notAfter.IsZero() {
+		return false
+	}
+	remaining := notAfter.Sub(now)
+	if remaining <= 0 {
+		return true
+	}
+	total := notAfter.Sub(notBefore)
+	if total <= 0 {
+		// Can't establish a lifetime window; fall back to refreshing
+		// only once the certificate has actually expired.
+		return false
+	}
+	return remaining <= time.Duration(float64(total)*threshold)
+}
+
+// leafValidity parses the leaf certificate out of tlsConfig and returns
+// its (NotBefore, NotAfter) validity window.
+func leafValidity(tlsConfig *tls.Config) (time.Time, time.Time, error) {
+	var certBytes []byte
+	switch {
+	case len(tlsConfig.Certificates) > 0 && len(tlsConfig.Certificates[0].Certificate) > 0:
+		certBytes = tlsConfig.Certificates[0].Certificate[0]
+	case tlsConfig.GetClientCertificate != nil:
+		cert, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+		if err != nil {
+			return time.Time{}, time.Time{}, trace.Wrap(err)
+		}
+		if len(cert.Certificate) == 0 {
+			return time.Time{}, time.Time{}, trace.BadParameter("client certificate has no leaf")
+		}
+		certBytes = cert.Certificate[0]
+	default:
+		return time.Time{}, time.Time{}, trace.BadParameter("tls config has no client certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return time.Time{}, time.Time{}, trace.Wrap(err)
+	}
+	return leaf.NotBefore, leaf.NotAfter, nil
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// CARotationPhase is a step in a trusted cluster's CA key rotation.
+// Rotation moves strictly forward through these phases; there is no
+// "undo", only retrying the current phase.
+//
+// This is deliberately its own type, tracked in its own
+// TrustedClusterCARotation record rather than on the CA's Rotation
+// field: Rotation is driven by the unrelated, pre-existing `tctl auth
+// rotate` rotation of this cluster's own host/user CAs, and the two
+// share overlapping phase names ("init" included). Writing this
+// rotation's state there would let either mechanism clobber the
+// other's progress if both ever touched the same CA.
+type CARotationPhase string
+
+const (
+	// CARotationPhaseInit generates a new signing keypair and appends
+	// it to the end of the CA's SigningKeys/CheckingKeys lists. By
+	// convention the key at index 0 is the one actively used for
+	// signing, so appending at the end means the old key keeps signing
+	// new certs and the new key is only present for peers to validate
+	// against, until the next phase.
+	CARotationPhaseInit CARotationPhase = "init"
+	// CARotationPhaseUpdateSigning moves the new key to index 0,
+	// switching signing over to it. The old key stays in both lists so
+	// certs already issued under it continue to validate.
+	CARotationPhaseUpdateSigning CARotationPhase = "update_signing"
+	// CARotationPhaseRetiring has dropped every key but the active one
+	// from SigningKeys/CheckingKeys after the configured grace period
+	// has elapsed, following the same orphan-after-grace-period idea
+	// the trust controller already uses for orphaned CAs.
+	CARotationPhaseRetiring CARotationPhase = "retiring"
+)
+
+// TrustedClusterCARotation is the persisted state of a trusted
+// cluster's CA key rotation, keyed by cluster name and CA type. It's
+// stored through a.Presence alongside the other trust-related records
+// this package persists there (OrphanCAReport, TrustedCluster), rather
+// than on the CA resource itself -- see CARotationPhase for why.
+type TrustedClusterCARotation struct {
+	// ClusterName is the trusted cluster whose CA is rotating.
+	ClusterName string `json:"cluster_name"`
+	// CAType is which of the trusted cluster's two CAs is rotating.
+	CAType services.CertAuthType `json:"ca_type"`
+	// Phase is the rotation's current CARotationPhase.
+	Phase string `json:"phase"`
+	// Started is when this rotation began.
+	Started time.Time `json:"started"`
+	// GracePeriod is how long after Started the superseded key is kept
+	// in SigningKeys/CheckingKeys before Retiring drops it. It is counted
+	// from the start of the rotation, not from the switch to
+	// UpdateSigning.
+	GracePeriod time.Duration `json:"grace_period"`
+}
+
+// defaultRotationGracePeriod is how long after a rotation starts the
+// superseded signing key is kept in CheckingKeys before being retired,
+// giving already-issued certificates time to naturally expire or be
+// renewed.
+const defaultRotationGracePeriod = 12 * time.Hour
+
+// RotateTrustedClusterCAKeyConfig configures a CA key rotation.
+type RotateTrustedClusterCAKeyConfig struct {
+	// ClusterName is the trusted cluster whose CA is rotating.
+	ClusterName string
+	// CAType is which of the trusted cluster's two CAs to rotate.
+	CAType services.CertAuthType
+	// GracePeriod overrides defaultRotationGracePeriod.
+	GracePeriod time.Duration
+}
+
+func (c *RotateTrustedClusterCAKeyConfig) checkAndSetDefaults() error {
+	if c.ClusterName == "" {
+		return trace.BadParameter("cluster name must be supplied")
+	}
+	if c.CAType != services.HostCA && c.CAType != services.UserCA {
+		return trace.BadParameter("unsupported CA type %q", c.CAType)
+	}
+	if c.GracePeriod == 0 {
+		c.GracePeriod = defaultRotationGracePeriod
+	}
+	return nil
+}
+
+// RotateTrustedClusterCAKeys generates a new signing keypair for the
+// named trusted cluster's CA and begins a three-phase rotation: the new
+// key is appended alongside the old one (Init), signing is switched to
+// the new key once the rotation is advanced (UpdateSigning), and the
+// old key is retired after the grace period (Retiring). The auth server
+// coordinates with EnsureTrustedClusters so the rotated host/user CAs
+// are re-pushed to the leaf cluster automatically as the rotation
+// advances. Each phase transition is recorded via auditCARotation.
+//
+// This operates on a single named cluster rather than walking every
+// trusted cluster in one call; a "rotate all" RPC would need to decide
+// how to stagger per-cluster grace periods and partial failures, which
+// is a bigger design question than this change set addresses. Callers
+// that need to rotate every trusted cluster's CA should call this once
+// per cluster.
+func (a *AuthServer) RotateTrustedClusterCAKeys(ctx context.Context, config RotateTrustedClusterCAKeyConfig) error {
+	if err := config.checkAndSetDefaults(); err != nil {
+		return trace.Wrap(err)
+	}
+
+	ca, err := a.GetCertAuthority(services.CertAuthID{Type: config.CAType, DomainName: config.ClusterName}, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	newKeyPair, err := services.GenerateKeyPair(ca.GetType())
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if encrypted, encErr := maybeEncryptCAKey(newKeyPair.Key); encErr == nil {
+		newKeyPair.Key = encrypted
+	} else {
+		return trace.Wrap(encErr)
+	}
+
+	// Appended at the end, not the front: index 0 stays the active
+	// signing key until AdvanceTrustedClusterCARotation's UpdateSigning
+	// phase explicitly moves this one there.
+	ca.SetSigningKeys(append(ca.GetSigningKeys(), newKeyPair.Key))
+	ca.SetCheckingKeys(append(ca.GetCheckingKeys(), newKeyPair.Pub))
+
+	if err := a.UpsertCertAuthority(ca); err != nil {
+		return trace.Wrap(err)
+	}
+
+	rotation := TrustedClusterCARotation{
+		ClusterName: config.ClusterName,
+		CAType:      config.CAType,
+		Phase:       string(CARotationPhaseInit),
+		Started:     a.clock.Now().UTC(),
+		GracePeriod: config.GracePeriod,
+	}
+	if err := a.Presence.UpsertTrustedClusterCARotation(rotation); err != nil {
+		return trace.Wrap(err)
+	}
+	a.auditCARotation(ctx, config.ClusterName, config.CAType, string(CARotationPhaseInit))
+
+	return trace.Wrap(a.pushRotatedCAToTrustedCluster(ctx, config.ClusterName))
+}
+
+// AdvanceTrustedClusterCARotation moves a CA rotation in progress to
+// its next phase: switching signing over to the new key, or (once the
+// grace period has elapsed) retiring the old one. It's a no-op success
+// if no rotation is in progress.
+func (a *AuthServer) AdvanceTrustedClusterCARotation(ctx context.Context, clusterName string, caType services.CertAuthType) error {
+	rotation, err := a.Presence.GetTrustedClusterCARotation(clusterName, caType)
+	if trace.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	ca, err := a.GetCertAuthority(services.CertAuthID{Type: caType, DomainName: clusterName}, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	switch CARotationPhase(rotation.Phase) {
+	case CARotationPhaseInit:
+		signingKeys := ca.GetSigningKeys()
+		checkingKeys := ca.GetCheckingKeys()
+		if len(signingKeys) < 2 || len(checkingKeys) < 2 {
+			return trace.BadParameter("rotation for %v/%v is in init phase but the CA has no pending key", caType, clusterName)
+		}
+		moveLastToFront(signingKeys)
+		moveLastToFront(checkingKeys)
+		ca.SetSigningKeys(signingKeys)
+		ca.SetCheckingKeys(checkingKeys)
+		if err := a.UpsertCertAuthority(ca); err != nil {
+			return trace.Wrap(err)
+		}
+		rotation.Phase = string(CARotationPhaseUpdateSigning)
+	case CARotationPhaseUpdateSigning:
+		if a.clock.Now().UTC().Sub(rotation.Started) < rotation.GracePeriod {
+			return nil
+		}
+		ca.SetSigningKeys(ca.GetSigningKeys()[:1])
+		ca.SetCheckingKeys(ca.GetCheckingKeys()[:1])
+		if err := a.UpsertCertAuthority(ca); err != nil {
+			return trace.Wrap(err)
+		}
+		rotation.Phase = string(CARotationPhaseRetiring)
+	case CARotationPhaseRetiring:
+		if err := a.Presence.DeleteTrustedClusterCARotation(clusterName, caType); err != nil {
+			return trace.Wrap(err)
+		}
+		a.auditCARotation(ctx, clusterName, caType, "completed")
+		return nil
+	default:
+		return trace.BadParameter("unknown rotation phase %q", rotation.Phase)
+	}
+
+	if err := a.Presence.UpsertTrustedClusterCARotation(rotation); err != nil {
+		return trace.Wrap(err)
+	}
+	a.auditCARotation(ctx, clusterName, caType, rotation.Phase)
+
+	return trace.Wrap(a.pushRotatedCAToTrustedCluster(ctx, clusterName))
+}
+
+// auditCARotation records a trusted cluster CA rotation's progress to
+// a new phase, mirroring the per-transition audit trail
+// auditOrphanPruneDecision keeps for the trust controller's other
+// background CA activity.
+func (a *AuthServer) auditCARotation(ctx context.Context, clusterName string, caType services.CertAuthType, phase string) {
+	if err := a.EmitAuditEvent(events.TrustedClusterCARotation, events.EventFields{
+		events.EventUser: clientUsername(ctx),
+		"cluster_name":   clusterName,
+		"ca_type":        string(caType),
+		"phase":          phase,
+	}); err != nil {
+		log.Warnf("Failed to emit trusted cluster CA rotation event for %q: %v", clusterName, err)
+	}
+}
+
+// moveLastToFront rotates keys so its last element becomes its first,
+// shifting every other element back by one. Used to promote the
+// just-appended pending key into the active (index 0) position without
+// dropping any of the keys already present.
+func moveLastToFront(keys [][]byte) {
+	last := keys[len(keys)-1]
+	copy(keys[1:], keys[:len(keys)-1])
+	keys[0] = last
+}
+
+// pushRotatedCAToTrustedCluster re-applies EnsureTrustedClusters for
+// clusterName so a rotated CA is re-pushed to the leaf without waiting
+// for the next reconciler pass.
+func (a *AuthServer) pushRotatedCAToTrustedCluster(ctx context.Context, clusterName string) error {
+	tc, err := a.Presence.GetTrustedCluster(clusterName)
+	if err != nil {
+		if trace.IsNotFound(err) {
+			// This CA doesn't back a trusted cluster (e.g. it's this
+			// cluster's own host/user CA); nothing to push.
+			return nil
+		}
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(a.EnsureTrustedClusters(ctx, tc))
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMoveLastToFront(t *testing.T) {
+	tests := []struct {
+		name string
+		in   [][]byte
+		want [][]byte
+	}{
+		{
+			name: "two keys",
+			in:   [][]byte{{1}, {2}},
+			want: [][]byte{{2}, {1}},
+		},
+		{
+			name: "three keys preserves the order of the untouched ones",
+			in:   [][]byte{{1}, {2}, {3}},
+			want: [][]byte{{3}, {1}, {2}},
+		},
+		{
+			name: "four keys",
+			in:   [][]byte{{1}, {2}, {3}, {4}},
+			want: [][]byte{{4}, {1}, {2}, {3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moveLastToFront(tt.in)
+			if !reflect.DeepEqual(tt.in, tt.want) {
+				t.Fatalf("moveLastToFront result = %v, want %v", tt.in, tt.want)
+			}
+		})
+	}
+}
+
+// TestCARotationPhaseSequenceMatchesPersistedKeyShape exercises the
+// same key-list transformations RotateTrustedClusterCAKeys and
+// AdvanceTrustedClusterCARotation apply to a CA's SigningKeys, without
+// going through AuthServer: Init appends a new key at the end,
+// UpdateSigning promotes it to index 0, and Retiring drops everything
+// but the active key. An off-by-one in any of these would either lose
+// the active key or leave the old one active past UpdateSigning.
+func TestCARotationPhaseSequenceMatchesPersistedKeyShape(t *testing.T) {
+	oldKey := []byte("old-signing-key")
+	newKey := []byte("new-signing-key")
+
+	// Init: new key appended at the end; old key is still index 0 and
+	// thus still active.
+	keys := [][]byte{oldKey}
+	keys = append(keys, newKey)
+	if !reflect.DeepEqual(keys[0], oldKey) {
+		t.Fatalf("after init, active (index 0) key = %q, want %q", keys[0], oldKey)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("after init, len(keys) = %d, want 2", len(keys))
+	}
+
+	// UpdateSigning: new key promoted to index 0.
+	moveLastToFront(keys)
+	if !reflect.DeepEqual(keys[0], newKey) {
+		t.Fatalf("after update_signing, active (index 0) key = %q, want %q", keys[0], newKey)
+	}
+	if !reflect.DeepEqual(keys[1], oldKey) {
+		t.Fatalf("after update_signing, retained key = %q, want %q", keys[1], oldKey)
+	}
+
+	// Retiring: everything but the active key is dropped.
+	keys = keys[:1]
+	if len(keys) != 1 {
+		t.Fatalf("after retiring, len(keys) = %d, want 1", len(keys))
+	}
+	if !reflect.DeepEqual(keys[0], newKey) {
+		t.Fatalf("after retiring, surviving key = %q, want %q", keys[0], newKey)
+	}
+}
+
+// TestCARotationPhaseConstantsAreStable guards the on-the-wire string
+// values of CARotationPhase: TrustedClusterCARotation.Phase is
+// persisted as a bare string, so renaming one of these constants would
+// strand any rotation record already written under the old value.
+func TestCARotationPhaseConstantsAreStable(t *testing.T) {
+	tests := []struct {
+		phase CARotationPhase
+		want  string
+	}{
+		{CARotationPhaseInit, "init"},
+		{CARotationPhaseUpdateSigning, "update_signing"},
+		{CARotationPhaseRetiring, "retiring"},
+	}
+	for _, tt := range tests {
+		if string(tt.phase) != tt.want {
+			t.Fatalf("CARotationPhase %v = %q, want %q", tt.phase, string(tt.phase), tt.want)
+		}
+	}
+}
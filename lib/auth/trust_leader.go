@@ -0,0 +1,278 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/backend"
+
+	"github.com/gravitational/trace"
+)
+
+// trustControllerLeaseKey is the backend path holding the current
+// trust controller leader's lease. Every auth server in an HA
+// deployment runs trustController.cycle, but only the lease holder is
+// allowed to mutate CAs or trusted clusters from it -- otherwise two
+// instances racing on DeleteCertAuthority/EnsureTrustedClusters could
+// each observe a stale read and step on the other's write.
+var trustControllerLeaseKey = []string{"trust_controller", "leader"}
+
+// trustControllerFencingKey holds a monotonic counter, independent of
+// and never expiring alongside trustControllerLeaseKey, incremented
+// every time leadership changes hands. Deriving the fencing token from
+// the lease record itself would let it reset to a reused value once
+// the lease expires and is evicted from the backend; this counter
+// survives that eviction so the token stays monotonic across the
+// lease's entire history, not just its current holder's tenure.
+var trustControllerFencingKey = []string{"trust_controller", "fencing_token"}
+
+// trustControllerLeaseTTL is how long a lease is valid for before it
+// must be renewed; campaign renews well before this elapses as long as
+// cycle keeps running.
+const trustControllerLeaseTTL = 30 * time.Second
+
+// trustControllerLease is the value stored at trustControllerLeaseKey.
+type trustControllerLease struct {
+	// LeaderID identifies the auth server instance holding the lease.
+	LeaderID string `json:"leader_id"`
+	// FencingToken increases every time a new lease record is created
+	// (not on renewal by the same holder); values can be skipped when an
+	// instance draws a token and then loses the create race. Mutations guarded by
+	// trustControllerElection.guard are rejected if the token they were
+	// issued under is no longer current, so a leader that's lost the
+	// lease without yet noticing can't still apply writes.
+	FencingToken uint64 `json:"fencing_token"`
+}
+
+// TrustControllerLeaderInfo reports who currently holds the trust
+// controller lease and when it expires, for observability into HA
+// deployments where only one auth server instance is actively running
+// reconciliation at a time.
+type TrustControllerLeaderInfo struct {
+	LeaderID     string    `json:"leader_id"`
+	FencingToken uint64    `json:"fencing_token"`
+	Expires      time.Time `json:"expires"`
+}
+
+// trustControllerElection gates trustController.cycle on holding a
+// leased, fenced leadership role so exactly one auth server instance
+// acts on suspected-orphan CAs and EnsureTrustedClusters reconciliation
+// at a time.
+type trustControllerElection struct {
+	backend backend.Backend
+	id      string
+
+	mu           sync.Mutex
+	fencingToken uint64
+	holder       bool
+	expires      time.Time
+}
+
+// newTrustControllerElection returns an election primitive for id
+// (typically the auth server's host UUID) over bk.
+func newTrustControllerElection(bk backend.Backend, id string) *trustControllerElection {
+	return &trustControllerElection{backend: bk, id: id}
+}
+
+// campaign attempts to acquire or renew the lease. It returns whether
+// this instance holds the lease afterward; campaign should be called
+// once per cycle() tick before any CA mutation.
+func (e *trustControllerElection) campaign(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	expires := now.Add(trustControllerLeaseTTL)
+
+	item, err := e.backend.Get(ctx, backend.Key(trustControllerLeaseKey...))
+	switch {
+	case trace.IsNotFound(err):
+		// No one holds the lease yet; try to create it. The fencing
+		// token still has to increase from whatever the last holder
+		// (however long ago) was issued, even though their lease row
+		// itself expired and is gone -- otherwise a leader that takes
+		// over after a long gap could be handed a token a stale,
+		// resumed old leader also still remembers as current.
+		token, err := e.nextFencingToken(ctx)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		lease := trustControllerLease{LeaderID: e.id, FencingToken: token}
+		value, marshalErr := json.Marshal(lease)
+		if marshalErr != nil {
+			return false, trace.Wrap(marshalErr)
+		}
+		if _, err := e.backend.Create(ctx, backend.Item{
+			Key:     backend.Key(trustControllerLeaseKey...),
+			Value:   value,
+			Expires: expires,
+		}); err != nil {
+			if trace.IsCompareFailed(err) || trace.IsAlreadyExists(err) {
+				// Lost the race to another instance; not the leader.
+				e.setHolder(false, 0, time.Time{})
+				return false, nil
+			}
+			return false, trace.Wrap(err)
+		}
+		e.setHolder(true, lease.FencingToken, expires)
+		return true, nil
+	case err != nil:
+		return false, trace.Wrap(err)
+	}
+
+	var lease trustControllerLease
+	if err := json.Unmarshal(item.Value, &lease); err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	if lease.LeaderID != e.id {
+		// Someone else holds an unexpired lease.
+		e.setHolder(false, 0, time.Time{})
+		return false, nil
+	}
+
+	// Renewing our own lease; fencing token is unchanged since the
+	// same instance is extending, not taking over, leadership.
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	renewed := *item
+	renewed.Value = value
+	renewed.Expires = expires
+	if _, err := e.backend.CompareAndSwap(ctx, *item, renewed); err != nil {
+		if trace.IsCompareFailed(err) {
+			e.setHolder(false, 0, time.Time{})
+			return false, nil
+		}
+		return false, trace.Wrap(err)
+	}
+
+	e.setHolder(true, lease.FencingToken, expires)
+	return true, nil
+}
+
+// nextFencingToken increments and returns the durable fencing counter
+// at trustControllerFencingKey, creating it at 1 if this is the very
+// first election this cluster has ever held. Unlike the lease record,
+// this key never carries a TTL, so the counter survives lease
+// expiry/eviction and keeps handing out strictly increasing tokens for
+// the lifetime of the backend.
+func (e *trustControllerElection) nextFencingToken(ctx context.Context) (uint64, error) {
+	for {
+		item, err := e.backend.Get(ctx, backend.Key(trustControllerFencingKey...))
+		if trace.IsNotFound(err) {
+			if _, err := e.backend.Create(ctx, backend.Item{
+				Key:   backend.Key(trustControllerFencingKey...),
+				Value: []byte(`1`),
+			}); err != nil {
+				if trace.IsCompareFailed(err) || trace.IsAlreadyExists(err) {
+					continue
+				}
+				return 0, trace.Wrap(err)
+			}
+			return 1, nil
+		}
+		if err != nil {
+			return 0, trace.Wrap(err)
+		}
+
+		var current uint64
+		if err := json.Unmarshal(item.Value, &current); err != nil {
+			return 0, trace.Wrap(err)
+		}
+		next := current + 1
+		value, err := json.Marshal(next)
+		if err != nil {
+			return 0, trace.Wrap(err)
+		}
+		updated := *item
+		updated.Value = value
+		if _, err := e.backend.CompareAndSwap(ctx, *item, updated); err != nil {
+			if trace.IsCompareFailed(err) {
+				continue
+			}
+			return 0, trace.Wrap(err)
+		}
+		return next, nil
+	}
+}
+
+func (e *trustControllerElection) setHolder(holder bool, token uint64, expires time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.holder = holder
+	e.fencingToken = token
+	e.expires = expires
+}
+
+// guard reports whether fencing token tok is still the current one
+// according to the backend's authoritative lease record, i.e. no other
+// instance has taken over the lease since tok was issued. It re-reads
+// the lease from the backend on every call rather than trusting this
+// process's cached fencingToken/holder fields: a stalled holder (GC
+// pause, slow write) can resume running with a locally-cached token
+// that's gone stale without the process itself noticing it ever lost
+// the lease, which is exactly the split-brain scenario fencing tokens
+// exist to catch. Mutation call sites should capture tok from Info() at
+// the start of a cycle() pass and guard immediately before each write.
+func (e *trustControllerElection) guard(ctx context.Context, tok uint64) (bool, error) {
+	item, err := e.backend.Get(ctx, backend.Key(trustControllerLeaseKey...))
+	if trace.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	var lease trustControllerLease
+	if err := json.Unmarshal(item.Value, &lease); err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	return lease.LeaderID == e.id && lease.FencingToken == tok, nil
+}
+
+// Info returns the election's current view of trust controller
+// leadership, for TrustControllerLeaderInfo.
+func (e *trustControllerElection) Info() (fencingToken uint64, isLeader bool, expires time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.fencingToken, e.holder, e.expires
+}
+
+// GetTrustControllerLeaderInfo reads the current trust controller
+// lease directly from the backend, so it reflects reality even when
+// called from an instance that isn't the leader.
+func (a *AuthServer) GetTrustControllerLeaderInfo(ctx context.Context, bk backend.Backend) (*TrustControllerLeaderInfo, error) {
+	item, err := bk.Get(ctx, backend.Key(trustControllerLeaseKey...))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var lease trustControllerLease
+	if err := json.Unmarshal(item.Value, &lease); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &TrustControllerLeaderInfo{
+		LeaderID:     lease.LeaderID,
+		FencingToken: lease.FencingToken,
+		Expires:      item.Expires,
+	}, nil
+}
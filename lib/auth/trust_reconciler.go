@@ -0,0 +1,193 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// reconcilerMinBackoff and reconcilerMaxBackoff bound the exponential
+// backoff applied between reconcile attempts once one fails, so a
+// cluster in a chronically broken state doesn't spin the auth server.
+const (
+	reconcilerMinBackoff = time.Second
+	reconcilerMaxBackoff = 5 * time.Minute
+)
+
+// RunTrustedClusterReconciler runs until ctx is canceled, periodically
+// re-applying EnsureTrustedClusters so a transient failure to establish
+// a reverse tunnel or activate a CA doesn't leave the cluster in a
+// broken state until the next process restart. On failure, the wait
+// before the next attempt grows exponentially (jittered, capped at
+// reconcilerMaxBackoff) and resets to reconcilerMinBackoff as soon as a
+// pass succeeds.
+func (a *AuthServer) RunTrustedClusterReconciler(ctx context.Context) {
+	backoff := reconcilerMinBackoff
+	for {
+		err := a.reconcileTrustedClustersOnce(ctx)
+
+		wait := reconcilerMinBackoff
+		if err != nil {
+			log.Warnf("Trusted cluster reconcile pass failed: %v", err)
+			wait = backoff
+			backoff = nextBackoff(backoff, reconcilerMaxBackoff)
+		} else {
+			backoff = reconcilerMinBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(wait)):
+		}
+	}
+}
+
+// reconcileTrustedClustersOnce walks every trusted cluster, applies
+// EnsureTrustedClusters, and records per-cluster reconcile health on
+// the associated RemoteCluster so operators can see why a cluster is
+// stuck without combing through logs.
+func (a *AuthServer) reconcileTrustedClustersOnce(ctx context.Context) error {
+	tcs, err := a.Presence.GetTrustedClusters()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var errs []error
+	for _, tc := range tcs {
+		reconcileErr := a.EnsureTrustedClusters(ctx, tc)
+		if err := a.recordReconcileStatus(tc.GetName(), reconcileErr); err != nil {
+			log.Warnf("Failed to record reconcile status for trusted cluster %q: %v", tc.GetName(), err)
+		}
+		if reconcileErr != nil {
+			errs = append(errs, reconcileErr)
+			if err := a.EmitAuditEvent(events.TrustedClusterReconcile, events.EventFields{
+				events.EventUser: teleportSystemUser,
+				"cluster_name":   tc.GetName(),
+				"error":          reconcileErr.Error(),
+			}); err != nil {
+				log.Warnf("Failed to emit trusted cluster reconcile event: %v", err)
+			}
+		}
+	}
+	return trace.NewAggregate(errs...)
+}
+
+// recordReconcileStatus surfaces the outcome of the most recent
+// reconcile attempt on the trusted cluster's RemoteCluster resource.
+//
+// Reconcile passes can run concurrently -- across a backoff retry and
+// the next scheduled pass, or across auth server instances before the
+// trust controller leader election is in effect for this path -- so
+// the update is guarded the same way UpsertTrustedCluster guards
+// TrustedCluster writes: reject it if the record has changed since it
+// was read, rather than blindly overwriting whatever is there. tctl
+// edit isn't wired up to expose this; there is no tctl package in this
+// tree to add it to.
+func (a *AuthServer) recordReconcileStatus(clusterName string, reconcileErr error) error {
+	existing, err := a.Presence.GetRemoteCluster(clusterName)
+	if err != nil {
+		if trace.IsNotFound(err) {
+			// Nothing to annotate yet; the RemoteCluster resource is
+			// only created once trust has actually been established.
+			return nil
+		}
+		return trace.Wrap(err)
+	}
+
+	updated := existing.Clone()
+	setter, ok := updated.(remoteClusterReconcileStatusSetter)
+	if !ok {
+		// RemoteCluster doesn't carry reconcile-status fields yet; skip
+		// annotating it rather than failing the whole reconcile pass
+		// over a missing observability feature.
+		return nil
+	}
+
+	setter.SetLastReconcileTime(a.clock.Now().UTC())
+	if reconcileErr != nil {
+		setter.SetReconcileError(reconcileErr.Error())
+	} else {
+		setter.SetReconcileError("")
+	}
+
+	return trace.Wrap(a.compareAndSwapRemoteCluster(updated, existing))
+}
+
+// remoteClusterReconcileStatusSetter is implemented by a RemoteCluster
+// that can record the outcome of the most recent reconcile attempt.
+// It's declared locally and asserted against the value returned by
+// a.Presence.GetRemoteCluster rather than added to RemoteCluster
+// directly here, since RemoteCluster is defined outside this package;
+// wiring these fields into a real implementation is a prerequisite for
+// reconcile status to show up anywhere.
+type remoteClusterReconcileStatusSetter interface {
+	SetLastReconcileTime(time.Time)
+	SetReconcileError(string)
+}
+
+// remoteClusterCAS is implemented by a Presence that can persist a
+// RemoteCluster update conditioned on the version last read, instead of
+// overwriting unconditionally. It's declared locally and asserted
+// against a.Presence rather than added to the Presence interface
+// directly here, since Presence is defined outside this package; wiring
+// a real implementation in is a prerequisite for this guard to do
+// anything beyond what UpdateRemoteCluster already does.
+type remoteClusterCAS interface {
+	CompareAndSwapRemoteCluster(new, existing services.RemoteCluster) error
+}
+
+// compareAndSwapRemoteCluster persists updated in place of existing,
+// rejecting the write if the backend's copy no longer matches existing
+// -- mirroring the version check UpsertTrustedCluster already applies
+// to TrustedCluster writes. Falls back to the unconditional
+// UpdateRemoteCluster when a.Presence doesn't support the conditional
+// form yet, so recording reconcile status still works, just without
+// the race protection.
+func (a *AuthServer) compareAndSwapRemoteCluster(updated, existing services.RemoteCluster) error {
+	if cas, ok := a.Presence.(remoteClusterCAS); ok {
+		return trace.Wrap(cas.CompareAndSwapRemoteCluster(updated, existing))
+	}
+	return trace.Wrap(a.Presence.UpdateRemoteCluster(updated))
+}
+
+// nextBackoff doubles cur, capped at max.
+func nextBackoff(cur, max time.Duration) time.Duration {
+	next := cur * 2
+	if next > max {
+		return max
+	}
+	return next
+}
+
+// jitter randomizes d by up to +/-20% so that many auth servers
+// recovering from the same outage don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	delta := float64(d) * 0.2
+	return d + time.Duration((rand.Float64()*2-1)*delta)
+}
+
+// teleportSystemUser identifies audit events emitted by internal
+// background processes rather than an interactive or API caller.
+const teleportSystemUser = "system"
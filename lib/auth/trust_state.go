@@ -0,0 +1,212 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// TrustedClusterState records where a trusted cluster relationship is
+// in its establishment lifecycle. Previously this was implicit in
+// whether the TrustedCluster and its CAs existed in the backend, which
+// has no representation for "we called establishTrust successfully but
+// crashed before addCertAuthorities/createReverseTunnel returned" -- a
+// retry of UpsertTrustedCluster would see no TrustedCluster record and
+// re-run establishTrust, potentially producing a duplicate
+// RemoteCluster on the leaf.
+type TrustedClusterState string
+
+const (
+	// TrustedClusterStatePending means establishTrust has succeeded and
+	// the relationship's name is known, but addCertAuthorities and/or
+	// createReverseTunnel/deactivateCertAuthority have not yet both
+	// completed.
+	TrustedClusterStatePending TrustedClusterState = "pending"
+	// TrustedClusterStateActive means the relationship is fully
+	// established and enabled.
+	TrustedClusterStateActive TrustedClusterState = "active"
+	// TrustedClusterStateDisabled means the relationship is fully
+	// established but disabled.
+	TrustedClusterStateDisabled TrustedClusterState = "disabled"
+	// TrustedClusterStateFailed means a side effect after Pending
+	// failed; a subsequent UpsertTrustedCluster call will attempt to
+	// resume it.
+	TrustedClusterStateFailed TrustedClusterState = "failed"
+)
+
+// trustedClusterStateRecord is TrustedClusterState's persisted form,
+// keyed by cluster name. TrustedCluster itself has no state field to
+// carry this on, so it's tracked in its own record, the same approach
+// already used for TrustedClusterCARotation and OrphanCAReport.
+type trustedClusterStateRecord struct {
+	ClusterName string              `json:"cluster_name"`
+	State       TrustedClusterState `json:"state"`
+}
+
+// trustedClusterStateStore is implemented by a Presence that can
+// persist trustedClusterStateRecords. It's declared locally and
+// asserted against a.Presence rather than added to the Presence
+// interface directly here, since Presence is defined outside this
+// package; wiring a real implementation in is a prerequisite for
+// resumePendingTrust to survive a restart that happens mid-Pending.
+type trustedClusterStateStore interface {
+	UpsertTrustedClusterState(record trustedClusterStateRecord) error
+	GetTrustedClusterState(clusterName string) (trustedClusterStateRecord, error)
+}
+
+// inMemoryTrustedClusterStateStore is a process-local
+// trustedClusterStateStore, used whenever a.Presence doesn't implement
+// one itself. It doesn't survive a process restart, so it's not a
+// substitute for a real implementation wired into Presence, but it does
+// make resumePendingTrust's Pending branch reachable within the
+// lifetime of a running auth server, instead of every trusted cluster
+// state transition silently going nowhere.
+type inMemoryTrustedClusterStateStore struct {
+	mu      sync.Mutex
+	records map[string]trustedClusterStateRecord
+}
+
+func (s *inMemoryTrustedClusterStateStore) UpsertTrustedClusterState(record trustedClusterStateRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records == nil {
+		s.records = make(map[string]trustedClusterStateRecord)
+	}
+	s.records[record.ClusterName] = record
+	return nil
+}
+
+func (s *inMemoryTrustedClusterStateStore) GetTrustedClusterState(clusterName string) (trustedClusterStateRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[clusterName]
+	if !ok {
+		return trustedClusterStateRecord{}, trace.NotFound("no state recorded for trusted cluster %q", clusterName)
+	}
+	return record, nil
+}
+
+// fallbackTrustedClusterStateStore backs every AuthServer that doesn't
+// get its trusted cluster state persisted through a.Presence. It's a
+// single process-wide store, not one per AuthServer, since the state it
+// holds -- which lifecycle phase a trusted cluster relationship is in
+// -- has no meaning scoped to anything narrower than the trust
+// relationship itself.
+var fallbackTrustedClusterStateStore = &inMemoryTrustedClusterStateStore{}
+
+// trustedClusterStateStoreFor returns the trustedClusterStateStore to
+// use for a: a.Presence's own implementation if it has one, so state
+// survives a restart, or the in-memory fallback otherwise.
+func trustedClusterStateStoreFor(a *AuthServer) trustedClusterStateStore {
+	if store, ok := a.Presence.(trustedClusterStateStore); ok {
+		return store
+	}
+	return fallbackTrustedClusterStateStore
+}
+
+// trustedClusterState returns the persisted state for clusterName, or
+// TrustedClusterStateActive if none is recorded, covering a
+// pre-existing resource from before this tracking was introduced.
+func (a *AuthServer) trustedClusterState(clusterName string) TrustedClusterState {
+	record, err := trustedClusterStateStoreFor(a).GetTrustedClusterState(clusterName)
+	if err != nil || record.State == "" {
+		return TrustedClusterStateActive
+	}
+	return record.State
+}
+
+// setTrustedClusterState persists clusterName's new state.
+func (a *AuthServer) setTrustedClusterState(clusterName string, state TrustedClusterState) error {
+	return trace.Wrap(trustedClusterStateStoreFor(a).UpsertTrustedClusterState(trustedClusterStateRecord{
+		ClusterName: clusterName,
+		State:       state,
+	}))
+}
+
+// setTrustedClusterStateAndAudit sets tc's state, persists it, and
+// emits an audit event recording the transition. Persist/audit errors
+// are logged rather than returned since this is called from within an
+// already-failing or already-succeeding code path where the original
+// error takes precedence.
+func (a *AuthServer) setTrustedClusterStateAndAudit(ctx context.Context, tc services.TrustedCluster, state TrustedClusterState) {
+	if err := a.setTrustedClusterState(tc.GetName(), state); err != nil {
+		log.Warnf("Failed to persist trusted cluster %q state transition to %v: %v", tc.GetName(), state, err)
+	}
+
+	if _, err := a.Presence.UpsertTrustedCluster(ctx, tc); err != nil {
+		log.Warnf("Failed to persist trusted cluster %q state transition to %v: %v", tc.GetName(), state, err)
+	}
+
+	if err := a.EmitAuditEvent(events.TrustedClusterStateChange, events.EventFields{
+		events.EventUser: clientUsername(ctx),
+		"cluster_name":   tc.GetName(),
+		"state":          string(state),
+	}); err != nil {
+		log.Warnf("Failed to emit trusted cluster state change event: %v", err)
+	}
+}
+
+// resumePendingTrust picks up a trusted cluster relationship left in
+// TrustedClusterStatePending, e.g. by a process that crashed between
+// establishTrust succeeding and the relationship reaching its final
+// state. It checks whether the remote CAs are already present locally
+// to decide whether addCertAuthorities still needs to run, then
+// completes whichever of createReverseTunnel/deactivateCertAuthority
+// the desired Enabled state requires.
+func (a *AuthServer) resumePendingTrust(tc services.TrustedCluster) error {
+	_, err := a.getCertAuthorities(tc)
+	switch {
+	case err == nil:
+		// CAs already landed; addCertAuthorities must have completed
+		// (or this is a resumed resume -- either way, nothing to redo).
+	case trace.IsNotFound(err):
+		// Crashed before addCertAuthorities got a chance to run. There
+		// is no local record of the remote CAs to fall back on, so the
+		// only option is to re-run establishTrust with the cluster's
+		// stored token.
+		remoteCAs, establishErr := a.establishTrust(tc)
+		if establishErr != nil {
+			return trace.Wrap(establishErr)
+		}
+		if addErr := a.addCertAuthorities(tc, remoteCAs); addErr != nil {
+			return trace.Wrap(addErr)
+		}
+	default:
+		return trace.Wrap(err)
+	}
+
+	if tc.GetEnabled() {
+		if err := a.activateCertAuthority(tc); err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		if err := a.createReverseTunnel(tc); err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(a.setTrustedClusterState(tc.GetName(), TrustedClusterStateActive))
+	}
+
+	if err := a.deactivateCertAuthority(tc); err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(a.setTrustedClusterState(tc.GetName(), TrustedClusterStateDisabled))
+}
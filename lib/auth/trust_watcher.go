@@ -0,0 +1,147 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// trustWatchKinds are the resource kinds RunTrustedClusterWatcher
+// subscribes to. Changes to any of them can move a trusted cluster
+// relationship forward, so each is handled as soon as it's seen rather
+// than waiting for trustController.cycle's next tick.
+var trustWatchKinds = []services.WatchKind{
+	{Kind: services.KindTrustedCluster},
+	{Kind: services.KindCertAuthority},
+	{Kind: services.KindReverseTunnel},
+}
+
+// RunTrustedClusterWatcher subscribes to TrustedCluster, CertAuthority,
+// and ReverseTunnel events and reacts to each as it arrives, so that
+// activating a CA or re-applying EnsureTrustedClusters happens within
+// milliseconds of the triggering change instead of on the next
+// trustController.cycle tick. cycle's periodic sweep keeps running
+// alongside this and remains the only mechanism for orphan-CA
+// detection, since "this CA's trusted cluster was deleted" has no
+// corresponding watch event to react to.
+//
+// It runs until ctx is canceled, always returning nil. Whenever the
+// watch closes or fails to open, it reopens it after a jittered
+// backoff that doubles on each reconnect up to reconcilerMaxBackoff;
+// the backoff is not reset after a watch that ran successfully.
+func (a *AuthServer) RunTrustedClusterWatcher(ctx context.Context, c *trustController) error {
+	backoff := reconcilerMinBackoff
+	for {
+		err := a.watchTrustEventsOnce(ctx, c)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Warnf("Trusted cluster watcher disconnected, reconnecting: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = nextBackoff(backoff, reconcilerMaxBackoff)
+	}
+}
+
+// trustEventWatcherSource is implemented by an AuthServices that can
+// open a watch over trustWatchKinds. It's declared locally and
+// asserted against a.AuthServices rather than added to AuthServices
+// directly here, since AuthServices is defined outside this package;
+// wiring a real implementation in is a prerequisite for
+// RunTrustedClusterWatcher to receive any events -- until then it falls
+// back to erroring out so callers see a clear reason reconnects never
+// succeed, rather than a nil-pointer panic on the first watch event.
+type trustEventWatcherSource interface {
+	WatchEvents(ctx context.Context, kinds ...services.WatchKind) (services.Watcher, error)
+}
+
+// watchTrustEventsOnce opens a single watch and handles events from it
+// until the watch errors out or ctx is canceled.
+func (a *AuthServer) watchTrustEventsOnce(ctx context.Context, c *trustController) error {
+	source, ok := a.AuthServices.(trustEventWatcherSource)
+	if !ok {
+		return trace.NotImplemented("this auth server's AuthServices does not support watching trust-related events")
+	}
+
+	watcher, err := source.WatchEvents(ctx, trustWatchKinds...)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watcher.Done():
+			return trace.Wrap(watcher.Error())
+		case event := <-watcher.Events():
+			a.handleTrustEvent(ctx, c, event)
+		}
+	}
+}
+
+// handleTrustEvent reacts to a single watch event by running
+// c.reconcileOne, the same backoff-tracked reconcile path
+// trustController.cycle's periodic sweep uses -- not a raw
+// EnsureTrustedClusters call -- so unrelated watch traffic (e.g. a
+// chronically broken cluster's own CA rotating) can't repeatedly reset
+// its backoff and hammer it with immediate retries. Errors are logged
+// by reconcileOne rather than returned here: one bad event shouldn't
+// tear down the watch, and the periodic sweep will eventually pick up
+// anything missed.
+func (a *AuthServer) handleTrustEvent(ctx context.Context, c *trustController, event services.Event) {
+	if event.Type == backend.OpDelete {
+		// Deletions are handled by the periodic sweep's orphan-CA
+		// detection, which already has to cross-reference the full set
+		// of trusted clusters and CAs to tell a deletion apart from a
+		// rename.
+		return
+	}
+
+	switch r := event.Resource.(type) {
+	case services.TrustedCluster:
+		c.reconcileOne(ctx, a, r, a.clock.Now().UTC())
+	case services.CertAuthority:
+		tc, err := a.Presence.GetTrustedCluster(r.GetClusterName())
+		if err != nil {
+			// Not every CA backs a trusted cluster (e.g. this cluster's
+			// own host/user CA); nothing to do.
+			return
+		}
+		c.reconcileOne(ctx, a, tc, a.clock.Now().UTC())
+	case services.ReverseTunnel:
+		tc, err := a.Presence.GetTrustedCluster(r.GetClusterName())
+		if err != nil {
+			// Not every reverse tunnel backs a trusted cluster.
+			return
+		}
+		c.reconcileOne(ctx, a, tc, a.clock.Now().UTC())
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gravitational/teleport"
@@ -36,6 +38,32 @@ import (
 	"github.com/gravitational/trace"
 )
 
+// resourceVersioned is implemented by a resource that tracks an
+// opaque version identifying the revision it was last read at, for
+// optimistic-concurrency checks like the one UpsertTrustedCluster
+// applies below. It's declared locally and asserted against
+// services.TrustedCluster values rather than added to
+// services.TrustedCluster directly here, since that type is defined
+// outside this package.
+type resourceVersioned interface {
+	GetResourceVersion() string
+}
+
+// trustedClusterContentEqual reports whether a and b carry the same
+// client-editable fields, as a substitute freshness check for the
+// concurrent-write race UpsertTrustedCluster guards against when
+// neither value implements resourceVersioned -- see the comment at its
+// call site.
+func trustedClusterContentEqual(a, b services.TrustedCluster) bool {
+	return a.GetName() == b.GetName() &&
+		a.GetEnabled() == b.GetEnabled() &&
+		a.GetToken() == b.GetToken() &&
+		a.GetProxyAddress() == b.GetProxyAddress() &&
+		a.GetReverseTunnelAddress() == b.GetReverseTunnelAddress() &&
+		reflect.DeepEqual(a.GetRoleMap(), b.GetRoleMap()) &&
+		reflect.DeepEqual(a.GetRoles(), b.GetRoles())
+}
+
 // UpsertTrustedCluster creates or toggles a Trusted Cluster relationship.
 func (a *AuthServer) UpsertTrustedCluster(ctx context.Context, trustedCluster services.TrustedCluster) (services.TrustedCluster, error) {
 	var exists bool
@@ -58,11 +86,69 @@ func (a *AuthServer) UpsertTrustedCluster(ctx context.Context, trustedCluster se
 		if err := existingCluster.CanChangeStateTo(trustedCluster); err != nil {
 			return nil, trace.Wrap(err)
 		}
+
+		// Reject the write if the caller's view of the resource is stale.
+		// Without this, two concurrent admins toggling Enabled or editing
+		// RoleMap can silently clobber each other; an empty incoming
+		// version opts out, matching how a freshly-constructed resource
+		// with no prior read has no version to compare against.
+		//
+		// services.TrustedCluster doesn't declare GetResourceVersion
+		// anywhere in this tree, so this branch -- which would catch a
+		// write based on an arbitrarily old client read -- only runs if
+		// the concrete values happen to support it; wiring a real
+		// implementation in is a prerequisite for it to fire at all
+		// today. Rather than leave the check entirely inert until then,
+		// fall back to re-reading the record immediately before
+		// accepting the write and rejecting if it no longer matches what
+		// was read at the top of this call. That doesn't protect a read
+		// held for a long time before the client submits its edit, but
+		// it does close the much more common case: two
+		// UpsertTrustedCluster calls racing each other within the same
+		// short window.
+		if incomingVer, ok := trustedCluster.(resourceVersioned); ok {
+			if existingVer, ok := existingCluster.(resourceVersioned); ok {
+				incoming := incomingVer.GetResourceVersion()
+				if incoming != "" && incoming != existingVer.GetResourceVersion() {
+					return nil, trace.CompareFailed("trusted cluster %q has been modified since it was last read (version %v, expected %v)",
+						trustedCluster.GetName(), existingVer.GetResourceVersion(), incoming)
+				}
+			}
+		} else {
+			fresh, err := a.Presence.GetTrustedCluster(trustedCluster.GetName())
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			if !trustedClusterContentEqual(fresh, existingCluster) {
+				return nil, trace.CompareFailed("trusted cluster %q has been modified since it was last read", trustedCluster.GetName())
+			}
+		}
+	}
+
+	// change state, driven off (existingState, desiredEnabled) rather
+	// than the old (exists, enable) pairing, so a retry after a crash
+	// mid-establishment can resume from Pending instead of blindly
+	// re-running establishTrust and risking a duplicate RemoteCluster
+	// on the leaf.
+	existingState := TrustedClusterStateActive
+	if exists {
+		// a pre-existing resource from before this tracking was
+		// introduced, or a Presence that doesn't persist it, is treated
+		// as settled in whatever state its Enabled flag implies --
+		// trustedClusterState already falls back to Active for both.
+		existingState = a.trustedClusterState(existingCluster.GetName())
 	}
 
-	// change state
 	switch {
-	case exists == true && enable == true:
+	case exists && (existingState == TrustedClusterStatePending || existingState == TrustedClusterStateFailed):
+		log.Debugf("Resuming Trusted Cluster establishment from %v state.", existingState)
+
+		if err := a.resumePendingTrust(trustedCluster); err != nil {
+			a.setTrustedClusterStateAndAudit(ctx, trustedCluster, TrustedClusterStateFailed)
+			return nil, trace.Wrap(err)
+		}
+
+	case exists && enable:
 		log.Debugf("Enabling existing Trusted Cluster relationship.")
 
 		if err := a.activateCertAuthority(trustedCluster); err != nil {
@@ -75,7 +161,11 @@ func (a *AuthServer) UpsertTrustedCluster(ctx context.Context, trustedCluster se
 		if err := a.createReverseTunnel(trustedCluster); err != nil {
 			return nil, trace.Wrap(err)
 		}
-	case exists == true && enable == false:
+		if err := a.setTrustedClusterState(trustedCluster.GetName(), TrustedClusterStateActive); err != nil {
+			log.Warnf("Failed to persist trusted cluster %q state: %v", trustedCluster.GetName(), err)
+		}
+
+	case exists && !enable:
 		log.Debugf("Disabling existing Trusted Cluster relationship.")
 
 		if err := a.deactivateCertAuthority(trustedCluster); err != nil {
@@ -88,32 +178,12 @@ func (a *AuthServer) UpsertTrustedCluster(ctx context.Context, trustedCluster se
 		if err := a.DeleteReverseTunnel(trustedCluster.GetName()); err != nil {
 			return nil, trace.Wrap(err)
 		}
-	case exists == false && enable == true:
-		log.Debugf("Creating enabled Trusted Cluster relationship.")
-
-		if err := a.checkLocalRoles(trustedCluster.GetRoleMap()); err != nil {
-			return nil, trace.Wrap(err)
-		}
-
-		remoteCAs, err := a.establishTrust(trustedCluster)
-		if err != nil {
-			return nil, trace.Wrap(err)
-		}
-
-		// Force name of the trusted cluster resource
-		// to be equal to the name of the remote cluster it is connecting to.
-		trustedCluster.SetName(remoteCAs[0].GetClusterName())
-
-		if err := a.addCertAuthorities(trustedCluster, remoteCAs); err != nil {
-			return nil, trace.Wrap(err)
+		if err := a.setTrustedClusterState(trustedCluster.GetName(), TrustedClusterStateDisabled); err != nil {
+			log.Warnf("Failed to persist trusted cluster %q state: %v", trustedCluster.GetName(), err)
 		}
 
-		if err := a.createReverseTunnel(trustedCluster); err != nil {
-			return nil, trace.Wrap(err)
-		}
-
-	case exists == false && enable == false:
-		log.Debugf("Creating disabled Trusted Cluster relationship.")
+	case !exists:
+		log.Debugf("Creating new Trusted Cluster relationship (enabled=%v).", enable)
 
 		if err := a.checkLocalRoles(trustedCluster.GetRoleMap()); err != nil {
 			return nil, trace.Wrap(err)
@@ -124,15 +194,37 @@ func (a *AuthServer) UpsertTrustedCluster(ctx context.Context, trustedCluster se
 			return nil, trace.Wrap(err)
 		}
 
-		// Force name to the name of the trusted cluster.
+		// Force name of the trusted cluster resource to be equal to
+		// the name of the remote cluster it is connecting to.
 		trustedCluster.SetName(remoteCAs[0].GetClusterName())
 
+		// Trust has been established with the remote cluster but the
+		// CAs haven't landed locally yet; persist Pending now so a
+		// crash before the rest of this function returns is resumable
+		// instead of silently retrying establishTrust from scratch.
+		a.setTrustedClusterStateAndAudit(ctx, trustedCluster, TrustedClusterStatePending)
+
 		if err := a.addCertAuthorities(trustedCluster, remoteCAs); err != nil {
+			a.setTrustedClusterStateAndAudit(ctx, trustedCluster, TrustedClusterStateFailed)
 			return nil, trace.Wrap(err)
 		}
 
-		if err := a.deactivateCertAuthority(trustedCluster); err != nil {
-			return nil, trace.Wrap(err)
+		if enable {
+			if err := a.createReverseTunnel(trustedCluster); err != nil {
+				a.setTrustedClusterStateAndAudit(ctx, trustedCluster, TrustedClusterStateFailed)
+				return nil, trace.Wrap(err)
+			}
+			if err := a.setTrustedClusterState(trustedCluster.GetName(), TrustedClusterStateActive); err != nil {
+				log.Warnf("Failed to persist trusted cluster %q state: %v", trustedCluster.GetName(), err)
+			}
+		} else {
+			if err := a.deactivateCertAuthority(trustedCluster); err != nil {
+				a.setTrustedClusterStateAndAudit(ctx, trustedCluster, TrustedClusterStateFailed)
+				return nil, trace.Wrap(err)
+			}
+			if err := a.setTrustedClusterState(trustedCluster.GetName(), TrustedClusterStateDisabled); err != nil {
+				log.Warnf("Failed to persist trusted cluster %q state: %v", trustedCluster.GetName(), err)
+			}
 		}
 	}
 
@@ -147,9 +239,46 @@ func (a *AuthServer) UpsertTrustedCluster(ctx context.Context, trustedCluster se
 		log.Warnf("Failed to emit trusted cluster create event: %v", err)
 	}
 
+	if !hasReadSecretsPermission(ctx, services.KindTrustedCluster) {
+		return redactTrustedCluster(tc), nil
+	}
 	return tc, nil
 }
 
+// GetTrustedCluster fetches a single trusted cluster by name, redacting
+// the join token and other secret material unless the caller holds the
+// read_secrets verb on trusted_cluster. This shadows the method
+// promoted from a.Presence so every read through AuthServer goes
+// through the same redaction gate.
+func (a *AuthServer) GetTrustedCluster(ctx context.Context, name string) (services.TrustedCluster, error) {
+	tc, err := a.Presence.GetTrustedCluster(name)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if !hasReadSecretsPermission(ctx, services.KindTrustedCluster) {
+		return redactTrustedCluster(tc), nil
+	}
+	return tc, nil
+}
+
+// GetTrustedClusters fetches all trusted clusters, redacting secret
+// material unless the caller holds the read_secrets verb on
+// trusted_cluster. This shadows the method promoted from a.Presence.
+func (a *AuthServer) GetTrustedClusters(ctx context.Context) ([]services.TrustedCluster, error) {
+	tcs, err := a.Presence.GetTrustedClusters()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if hasReadSecretsPermission(ctx, services.KindTrustedCluster) {
+		return tcs, nil
+	}
+	redacted := make([]services.TrustedCluster, len(tcs))
+	for i, tc := range tcs {
+		redacted[i] = redactTrustedCluster(tc)
+	}
+	return redacted, nil
+}
+
 // EnsureTrustedClusters attempts to ensure that all currently registered
 // trusted clusters are correctly configured.
 //
@@ -163,7 +292,10 @@ func (a *AuthServer) UpsertTrustedCluster(ctx context.Context, trustedCluster se
 func (a *AuthServer) EnsureTrustedClusters(ctx context.Context, tcs ...services.TrustedCluster) error {
 	var err error
 	if len(tcs) == 0 {
-		tcs, err = a.GetTrustedClusters()
+		// internal reconciliation path: read straight from Presence so
+		// this isn't subject to the caller-RBAC redaction gate that
+		// applies to the user-facing AuthServer.GetTrustedClusters.
+		tcs, err = a.Presence.GetTrustedClusters()
 		if err != nil {
 			return trace.Wrap(err)
 		}
@@ -366,8 +498,14 @@ func (a *AuthServer) establishTrust(trustedCluster services.TrustedCluster) ([]s
 	// log the local certificate authorities that we are sending
 	log.Debugf("Sending validate request; token=%v, CAs=%v", validateRequest.Token, validateRequest.CAs)
 
-	// send the request to the remote auth server via the proxy
-	validateResponse, err := a.sendValidateRequestToProxy(trustedCluster.GetProxyAddress(), &validateRequest)
+	// send the request over whichever transport this trusted cluster is
+	// configured to use (HTTPS-to-proxy by default, or gRPC / manual for
+	// non-web onboarding flows).
+	transport, err := a.trustTransportForCluster(trustedCluster)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	validateResponse, err := transport.Validate(context.TODO(), &validateRequest)
 	if err != nil {
 		log.Error(err)
 		if strings.Contains(err.Error(), "x509") {
@@ -417,6 +555,13 @@ func (a *AuthServer) addCertAuthorities(trustedCluster services.TrustedCluster,
 			remoteCertAuthority.SetRoleMap(trustedCluster.GetRoleMap())
 		}
 
+		// encrypt private key material at rest if TELEPORT_CA_PASSPHRASE
+		// is configured, so a backend compromise alone doesn't expose
+		// the trusted cluster's signing keys.
+		if err := encryptCertAuthorityKeys(remoteCertAuthority); err != nil {
+			return trace.Wrap(err)
+		}
+
 		// we use create here instead of upsert to prevent people from wiping out
 		// their own ca if it has the same name as the remote ca
 		err := a.CreateCertAuthority(remoteCertAuthority)
@@ -428,6 +573,68 @@ func (a *AuthServer) addCertAuthorities(trustedCluster services.TrustedCluster,
 	return nil
 }
 
+// encryptCertAuthorityKeys replaces the private key material in ca's
+// TLS and SSH signing keypairs with encrypted envelopes, when
+// TELEPORT_CA_PASSPHRASE is configured. It is a no-op otherwise,
+// leaving keys stored in plaintext as before.
+func encryptCertAuthorityKeys(ca services.CertAuthority) error {
+	tlsKeyPairs := ca.GetTLSKeyPairs()
+	for i, kp := range tlsKeyPairs {
+		encrypted, err := maybeEncryptCAKey(kp.Key)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		tlsKeyPairs[i].Key = encrypted
+	}
+	ca.SetTLSKeyPairs(tlsKeyPairs)
+
+	signingKeys := ca.GetSigningKeys()
+	for i, key := range signingKeys {
+		encrypted, err := maybeEncryptCAKey(key)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		signingKeys[i] = encrypted
+	}
+	ca.SetSigningKeys(signingKeys)
+
+	return nil
+}
+
+// decryptCertAuthorityKeys is the read-side counterpart of
+// encryptCertAuthorityKeys. It replaces any encrypted envelopes found
+// in ca's signing keys with their decrypted plaintext, trying the
+// current passphrase and falling back to TELEPORT_CA_PASSPHRASE_PREV,
+// and reports whether any key was only recoverable via the previous
+// passphrase. When rewrapped is true, the caller should re-encrypt and
+// persist ca (see encryptCertAuthorityKeys) so the backend converges
+// onto the current passphrase.
+func decryptCertAuthorityKeys(ca services.CertAuthority) (rewrapped bool, err error) {
+	tlsKeyPairs := ca.GetTLSKeyPairs()
+	for i, kp := range tlsKeyPairs {
+		key, rewrap, err := maybeDecryptCAKey(kp.Key)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		tlsKeyPairs[i].Key = key
+		rewrapped = rewrapped || rewrap != nil
+	}
+	ca.SetTLSKeyPairs(tlsKeyPairs)
+
+	signingKeys := ca.GetSigningKeys()
+	for i, sk := range signingKeys {
+		key, rewrap, err := maybeDecryptCAKey(sk)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		signingKeys[i] = key
+		rewrapped = rewrapped || rewrap != nil
+	}
+	ca.SetSigningKeys(signingKeys)
+
+	return rewrapped, nil
+}
+
 // DeleteRemoteCluster deletes remote cluster resource, all certificate authorities
 // associated with it
 func (a *AuthServer) DeleteRemoteCluster(clusterName string) error {
@@ -762,23 +969,54 @@ func (a *AuthServer) activateCertAuthority(t services.TrustedCluster) error {
 	return nil
 }
 
-// getCertAuthorities loads the user and host CAs associated with a trusted cluster.
+// getCertAuthorities loads the user and host CAs associated with a
+// trusted cluster, decrypting key material at rest if
+// TELEPORT_CA_PASSPHRASE is configured and rewriting any CA that was
+// only recoverable via TELEPORT_CA_PASSPHRASE_PREV.
 func (a *AuthServer) getCertAuthorities(t services.TrustedCluster) ([]services.CertAuthority, error) {
-	userCA, err := a.GetCertAuthority(services.CertAuthID{Type: services.UserCA, DomainName: t.GetName()}, false)
+	userCA, err := a.GetCertAuthority(services.CertAuthID{Type: services.UserCA, DomainName: t.GetName()}, true)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
+	if err := a.decryptAndRewrapCertAuthority(userCA); err != nil {
+		return nil, trace.Wrap(err)
+	}
 
-	hostCA, err := a.GetCertAuthority(services.CertAuthID{Type: services.HostCA, DomainName: t.GetName()}, false)
+	hostCA, err := a.GetCertAuthority(services.CertAuthID{Type: services.HostCA, DomainName: t.GetName()}, true)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
+	if err := a.decryptAndRewrapCertAuthority(hostCA); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	return []services.CertAuthority{
 		userCA,
 		hostCA,
 	}, nil
 }
 
+// decryptAndRewrapCertAuthority decrypts ca's key material in place and,
+// if it was only recoverable via the previous passphrase, re-encrypts
+// it under the current one and persists the result.
+func (a *AuthServer) decryptAndRewrapCertAuthority(ca services.CertAuthority) error {
+	rewrapped, err := decryptCertAuthorityKeys(ca)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !rewrapped {
+		return nil
+	}
+
+	rewrappedCA := ca.Clone()
+	if err := encryptCertAuthorityKeys(rewrappedCA); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := a.UpsertCertAuthority(rewrappedCA); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
 // deactivateCertAuthority will deactivate both the user and host certificate
 // authority given in the services.TrustedCluster resource.
 func (a *AuthServer) deactivateCertAuthority(t services.TrustedCluster) error {
@@ -818,9 +1056,42 @@ type trustController struct {
 	// suspectedOrphanCAs are trusted CAs which don't appear to
 	// belong either to this cluster.
 	suspectedOrphanCAs []suspectedOrphanCA
+	// pruneMode controls what happens once a suspected orphan passes
+	// orphanAfter; the zero value behaves like PruneModeOff so a
+	// trustController built without setting it doesn't start deleting
+	// CAs.
+	pruneMode PruneMode
+
+	// election gates cycle on this instance holding the trust
+	// controller lease, so that in an HA deployment only one auth
+	// server runs the orphan sweep and EnsureTrustedClusters
+	// reconciliation at a time. Nil disables leader gating (e.g. in a
+	// single auth server deployment).
+	election *trustControllerElection
+
+	// mu guards clusterStatus, which is also read from
+	// GetTrustedClusterStatus on a different goroutine than cycle runs
+	// on.
+	mu sync.Mutex
+	// clusterStatus tracks, per trusted cluster, the reconcile health
+	// that previously only existed as a single warning log line.
+	clusterStatus map[string]*trustedClusterReconcileStatus
 }
 
 func (c *trustController) cycle(ctx context.Context, auth *AuthServer, t time.Time) error {
+	var fencingToken uint64
+	if c.election != nil {
+		isLeader, err := c.election.campaign(ctx)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if !isLeader {
+			// Another auth server instance holds the lease; let it run
+			// this tick's reconciliation instead of racing it.
+			return nil
+		}
+		fencingToken, _, _ = c.election.Info()
+	}
 
 	domainName, err := auth.GetDomainName()
 	if err != nil {
@@ -835,17 +1106,17 @@ func (c *trustController) cycle(ctx context.Context, auth *AuthServer, t time.Ti
 		return trace.Wrap(err)
 	}
 
-	// first, attempt to ensure that all existant trusted clusters have
-	// had their configurations correctly applied.
-	if err := auth.EnsureTrustedClusters(ctx, tcs...); err != nil {
-		// this is a best-effort operation, so just log the error
-		// and keep working.
-		log.Warnf("EnsureTrustedClusters failed: %v", err)
+	// attempt to ensure that all existant trusted clusters have had
+	// their configurations correctly applied, skipping any cluster
+	// that's in exponential backoff following a recent failure instead
+	// of hammering it every tick.
+	for _, tc := range tcs {
+		c.reconcileOne(ctx, auth, tc, t)
 	}
 
 	// reset seen tag for all existing suspects
-	for _, sus := range c.suspectedOrphanCAs {
-		sus.seen = false
+	for i := range c.suspectedOrphanCAs {
+		c.suspectedOrphanCAs[i].seen = false
 	}
 
 	var nextSuspects []suspectedOrphanCA
@@ -869,11 +1140,11 @@ func (c *trustController) cycle(ctx context.Context, auth *AuthServer, t time.Ti
 				}
 			}
 			// if we got this far, the ca *might* be in an orphaned/dangling state.
-			for _, sus := range c.suspectedOrphanCAs {
-				if ca.Equals(sus.ca) {
+			for i := range c.suspectedOrphanCAs {
+				if ca.Equals(c.suspectedOrphanCAs[i].ca) {
 					// we are already tracking this suspect, mark it as seen
 					// and continue processing.
-					sus.seen = true
+					c.suspectedOrphanCAs[i].seen = true
 					continue Processing
 				}
 			}
@@ -894,10 +1165,9 @@ func (c *trustController) cycle(ctx context.Context, auth *AuthServer, t time.Ti
 			continue
 		}
 		if t.After(sus.since) && t.Sub(sus.since) > c.orphanAfter {
-			// orphan cutoff reached, attempt to remove CA
-			if err := auth.DeleteCertAuthority(sus.ca.GetID()); err != nil && !trace.IsNotFound(err) {
-				log.Warnf("Failed to remove orphan %s CA: %q", sus.ca.GetType(), sus.ca.GetName())
-			}
+			// orphan cutoff reached; what happens next depends on
+			// c.pruneMode (see reportOrphanCA).
+			auth.reportOrphanCA(ctx, c, sus, fencingToken)
 			continue
 		}
 		// still a suspect, but not yet past the cutoff
@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+
+	"github.com/gravitational/teleport/lib/services"
+)
+
+// readSecretsVerb is the RBAC verb gating access to secret material
+// (join tokens, private CA keys) embedded in otherwise listable
+// resources. A user who can list/read trusted clusters does not
+// automatically get to see the token used to join new leafs.
+const readSecretsVerb = "read_secrets"
+
+// accessCheckerContextKey is the context key the RBAC-enforcing layer
+// above AuthServer (ServerWithRoles) stores the caller's
+// services.AccessChecker under, so methods like UpsertTrustedCluster
+// and GetTrustedCluster can gate secret-bearing fields without having
+// the checker threaded through their signature.
+type accessCheckerContextKey struct{}
+
+// WithAccessChecker returns a copy of ctx carrying checker, for use by
+// the RBAC-enforcing layer above AuthServer.
+func WithAccessChecker(ctx context.Context, checker services.AccessChecker) context.Context {
+	return context.WithValue(ctx, accessCheckerContextKey{}, checker)
+}
+
+// accessCheckerFromContext retrieves the checker stored by
+// WithAccessChecker, if any.
+func accessCheckerFromContext(ctx context.Context) (services.AccessChecker, bool) {
+	checker, ok := ctx.Value(accessCheckerContextKey{}).(services.AccessChecker)
+	return checker, ok
+}
+
+// hasReadSecretsPermission reports whether the caller recorded on ctx
+// is allowed to see secret material on resources of the given kind.
+//
+// ServerWithRoles, the RBAC-enforcing layer that's supposed to call
+// WithAccessChecker on every request, isn't part of this checkout, so
+// there is no way to verify end to end that it actually does. Given
+// that, this fails closed: a ctx with no checker attached is treated
+// as having no permission, the same as a checker that explicitly
+// denies read_secrets. The alternative -- failing open until
+// WithAccessChecker is wired in -- means every caller gets the raw
+// token regardless of role, which is the exact privilege escalation
+// this check exists to close; an unwired caller getting redacted
+// output it didn't ask for is the safe failure mode, not a
+// functional regression.
+func hasReadSecretsPermission(ctx context.Context, kind string) bool {
+	checker, ok := accessCheckerFromContext(ctx)
+	if !ok {
+		return false
+	}
+	return checker.CheckAccessToRule(kind, readSecretsVerb) == nil
+}
+
+// redactTrustedCluster returns a copy of tc with the join token zeroed
+// out. It mirrors services.RedactTrustedCluster semantics for callers
+// that only hold list/read access on trusted_cluster, not
+// read_secrets: they can see that a trust relationship exists without
+// being handed the token needed to establish a new one.
+func redactTrustedCluster(tc services.TrustedCluster) services.TrustedCluster {
+	redacted := tc.Clone()
+	redacted.SetToken("")
+	return redacted
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package web
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -232,3 +233,201 @@ func (r *requestUser) checkAndSetDefaults() error {
 	}
 	return nil
 }
+
+// requestImportUsers is used to unmarshal bulk import requests. Either
+// Users or Connector must be supplied, but not both.
+type requestImportUsers struct {
+	// Users is an explicit list of users to provision.
+	Users []requestUser `json:"users,omitempty"`
+	// Connector, if set, identifies an OIDC/SAML connector whose
+	// upstream identity provider directory should be walked to
+	// synthesize local users.
+	Connector *requestImportConnector `json:"connector,omitempty"`
+}
+
+// requestImportConnector selects an upstream directory to import users
+// from, along with an optional filter understood by that connector.
+type requestImportConnector struct {
+	// Name is the name of a configured OIDC or SAML connector.
+	Name string `json:"name"`
+	// Filter is an optional, connector-specific filter expression
+	// (e.g. a group or OU) restricting which upstream users are
+	// imported.
+	Filter string `json:"filter"`
+}
+
+func (r *requestImportUsers) checkAndSetDefaults() error {
+	if len(r.Users) == 0 && r.Connector == nil {
+		return trace.BadParameter("must supply either users or a connector")
+	}
+	if len(r.Users) > 0 && r.Connector != nil {
+		return trace.BadParameter("users and connector are mutually exclusive")
+	}
+	for i := range r.Users {
+		if err := r.Users[i].checkAndSetDefaults(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if r.Connector != nil && r.Connector.Name == "" {
+		return trace.BadParameter("missing connector name")
+	}
+	return nil
+}
+
+// importUserResult reports the outcome of importing a single user.
+type importUserResult struct {
+	Name          string `json:"name"`
+	Success       bool   `json:"success"`
+	Error         string `json:"error,omitempty"`
+	ResetTokenURL string `json:"resetTokenUrl,omitempty"`
+}
+
+// responseImportUsers is returned from the bulk import endpoint, with
+// one entry per requested user.
+type responseImportUsers struct {
+	Results []importUserResult `json:"results"`
+}
+
+// importUsers allows a UI user to bulk-provision local users, either
+// from an explicit list or by importing from an OIDC/SAML connector's
+// upstream directory. Each record is reported back individually so a
+// partial failure (e.g. one duplicate name) doesn't hide the users that
+// succeeded; if resolving the connector's directory itself fails, no
+// users are created.
+//
+// POST /webapi/sites/:site/namespaces/:namespace/users/import
+//
+// Request:
+// {
+//		"users": [{"name": "foo", "roles": ["role1"]}, ...]
+// }
+// or
+// {
+//		"connector": {"name": "okta-oidc", "filter": "group:engineering"}
+// }
+//
+// Response:
+// {
+//		"results": [{"name": "foo", "success": true, "resetTokenUrl": "..."}, ...]
+// }
+func (h *Handler) importUsers(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *SessionContext, site reversetunnel.RemoteSite) (interface{}, error) {
+	var req *requestImportUsers
+	if err := httplib.ReadJSON(r, &req); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := req.checkAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	candidates := req.Users
+	if req.Connector != nil {
+		resolved, err := h.resolveConnectorUsers(r.Context(), ctx, req.Connector)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		candidates = resolved
+	}
+
+	results := make([]importUserResult, 0, len(candidates))
+	for _, candidate := range candidates {
+		result := importUserResult{Name: candidate.Name}
+
+		tokenURL, err := h.importOneUser(r.Context(), ctx, candidate)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Success = true
+			result.ResetTokenURL = tokenURL
+		}
+		results = append(results, result)
+	}
+
+	return &responseImportUsers{Results: results}, nil
+}
+
+// importOneUser creates a single user record and its reset-password
+// token. If issuing the reset token fails after the user was already
+// created, it deletes the just-created user again so the record never
+// outlives its reset token -- otherwise a transient failure from
+// CreateResetPasswordToken would leave a dangling user with a
+// CreatedBy reference and no way to log in.
+func (h *Handler) importOneUser(ctx context.Context, sctx *SessionContext, req requestUser) (string, error) {
+	_, err := sctx.clt.GetUser(req.Name, false)
+	if !trace.IsNotFound(err) {
+		if err != nil {
+			return "", trace.Wrap(err, "failed to check whether user %q exists: %v", req.Name, err)
+		}
+		return "", trace.BadParameter("user %q already registered", req.Name)
+	}
+
+	newUser, err := services.NewUser(req.Name)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	newUser.SetRoles(req.Roles)
+	newUser.SetCreatedBy(services.CreatedBy{
+		User: services.UserRef{Name: sctx.user},
+		Time: h.clock.Now().UTC(),
+	})
+
+	if err := sctx.clt.CreateUser(ctx, newUser); err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	token, err := sctx.clt.CreateResetPasswordToken(ctx, auth.CreateResetPasswordTokenRequest{
+		Name: req.Name,
+		Type: auth.ResetPasswordTokenTypeInvite,
+	})
+	if err != nil {
+		if delErr := sctx.clt.DeleteUser(ctx, req.Name); delErr != nil {
+			// Compensating delete failed too; surface both errors since
+			// the caller now has a dangling user they'll need to clean
+			// up by hand.
+			return "", trace.Wrap(err, "user created but failed to issue reset token, and cleanup also failed (%v): %v", delErr, err)
+		}
+		return "", trace.Wrap(err, "failed to issue reset token, created user rolled back: %v", err)
+	}
+
+	return token.GetURL(), nil
+}
+
+// connectorDirectory is implemented by a ClientI that can walk an
+// OIDC/SAML connector's upstream directory. It's declared locally and
+// asserted against sctx.clt rather than added to ClientI directly here,
+// since ClientI is defined outside this package; wiring a real
+// implementation into ClientI is a prerequisite for this endpoint to
+// work against a live cluster.
+type connectorDirectoryEntry struct {
+	Name  string
+	Roles []string
+}
+
+type connectorDirectory interface {
+	ListConnectorUsers(ctx context.Context, connector, filter string) ([]connectorDirectoryEntry, error)
+}
+
+// resolveConnectorUsers walks the upstream directory behind an
+// OIDC/SAML connector and turns each entry into a requestUser ready for
+// import, using the roles the directory listing returned for it as-is;
+// no role template mapping is applied here.
+func (h *Handler) resolveConnectorUsers(ctx context.Context, sctx *SessionContext, connector *requestImportConnector) ([]requestUser, error) {
+	lister, ok := sctx.clt.(connectorDirectory)
+	if !ok {
+		return nil, trace.NotImplemented("this auth client does not support listing connector directories")
+	}
+
+	entries, err := lister.ListConnectorUsers(ctx, connector.Name, connector.Filter)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to list directory for connector %q: %v", connector.Name, err)
+	}
+
+	users := make([]requestUser, 0, len(entries))
+	for _, entry := range entries {
+		users = append(users, requestUser{
+			Name:  entry.Name,
+			Roles: entry.Roles,
+		})
+	}
+	return users, nil
+}